@@ -2,6 +2,7 @@ package states
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/terraform/addrs"
 	"github.com/zclconf/go-cty/cty"
@@ -90,7 +91,15 @@ func (ms *Module) SetResourceInstanceCurrent(addr addrs.ResourceInstance, obj *R
 	is.Current = obj
 
 	if !is.HasObjects() {
-		// If we have no objects at all then we'll clean up.
+		// If we have no objects at all then we'll clean up. Note that this
+		// is a genuine, final removal rather than a step in the
+		// create-before-destroy dance: while a replacement is in flight the
+		// old object lives on in Deposed (moved there by
+		// DeposeResourceInstanceObject), so HasObjects keeps reporting true
+		// and any ProviderOverride/DriftStatus recorded on the instance
+		// rides along untouched until the dance completes. Only once both
+		// Current and Deposed are empty do we drop the instance, and its
+		// annotations along with it.
 		delete(rs.Instances, addr.Key)
 	}
 	if rs.EachMode == NoEach && len(rs.Instances) == 0 {
@@ -124,10 +133,18 @@ func (ms *Module) SetResourceInstanceDeposed(addr addrs.ResourceInstance, key De
 	}
 	is := rs.EnsureInstance(addr.Key)
 
-	is.Current = obj
+	if obj == nil {
+		delete(is.Deposed, key)
+	} else {
+		if is.Deposed == nil {
+			is.Deposed = make(map[DeposedKey]*ResourceInstanceObject)
+		}
+		is.Deposed[key] = obj
+	}
 
 	if !is.HasObjects() {
-		// If we have no objects at all then we'll clean up.
+		// See the equivalent check in SetResourceInstanceCurrent: this only
+		// triggers once the instance has truly nothing left.
 		delete(rs.Instances, addr.Key)
 	}
 	if rs.EachMode == NoEach && len(rs.Instances) == 0 {
@@ -152,6 +169,72 @@ func (ms *Module) DeposeResourceInstanceObject(addr addrs.ResourceInstance) Depo
 	return is.DeposeCurrentObject()
 }
 
+// SetResourceInstanceProvider records an instance-level provider
+// configuration address for the resource instance with the given address,
+// overriding the resource-wide default recorded by SetResourceMeta.
+//
+// This exists to support a `provider = ` argument that appears directly on
+// an individual count/for_each instance rather than on the resource as a
+// whole, which is unusual but valid. Most instances never need this set.
+//
+// The resource that contains the given instance must already exist in the
+// state, or this method will panic. Use Resource to check first if its
+// presence is not already guaranteed.
+func (ms *Module) SetResourceInstanceProvider(addr addrs.ResourceInstance, provider addrs.AbsProviderConfig) {
+	rs := ms.Resource(addr.Resource)
+	if rs == nil {
+		panic(fmt.Sprintf("attempt to set instance provider for non-existent resource %s", addr.Resource.Absolute(ms.Addr)))
+	}
+	is := rs.EnsureInstance(addr.Key)
+	is.ProviderOverride = &provider
+}
+
+// ResourceInstanceProvider returns the provider configuration address that
+// applies to the resource instance with the given address: its own
+// instance-level override if SetResourceInstanceProvider has been called
+// for it, or otherwise the resource-wide default recorded in
+// rs.ProviderConfig.
+//
+// The result is the zero value of addrs.AbsProviderConfig if the resource
+// containing the given instance isn't tracked in the state at all. If the
+// resource is tracked but the instance is not, the result is the
+// resource-wide default.
+func (ms *Module) ResourceInstanceProvider(addr addrs.ResourceInstance) addrs.AbsProviderConfig {
+	rs := ms.Resource(addr.Resource)
+	if rs == nil {
+		return addrs.AbsProviderConfig{}
+	}
+	if is := rs.Instance(addr.Key); is != nil && is.hasProviderOverride() {
+		return *is.ProviderOverride
+	}
+	return rs.ProviderConfig
+}
+
+// MarkResourceInstanceDrift records the outcome of a drift detection check
+// against the resource instance with the given address, along with the
+// time the check was performed. An in-sync result also records the hash of
+// the current object as the instance's LastKnownHash.
+//
+// The recorded drift fields are held in memory only: no state serializer
+// reads or writes them, so they do not survive a round trip through a
+// persisted state file.
+//
+// The resource that contains the given instance must already exist in the
+// state, or this method will panic. Use Resource to check first if its
+// presence is not already guaranteed.
+func (ms *Module) MarkResourceInstanceDrift(addr addrs.ResourceInstance, status DriftStatus, checkedAt time.Time) {
+	rs := ms.Resource(addr.Resource)
+	if rs == nil {
+		panic(fmt.Sprintf("attempt to mark drift for non-existent resource %s", addr.Resource.Absolute(ms.Addr)))
+	}
+	is := rs.EnsureInstance(addr.Key)
+	is.DriftStatus = status
+	is.DriftCheckedAt = checkedAt
+	if status == DriftStatusInSync && is.Current != nil {
+		is.LastKnownHash = is.Current.Hash()
+	}
+}
+
 // SetOutputValue writes an output value into the state, overwriting any
 // existing value of the same name.
 func (ms *Module) SetOutputValue(name string, value cty.Value, sensitive bool) *OutputValue {
@@ -0,0 +1,145 @@
+package states
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/addrs"
+)
+
+func testInstanceAddr(name string) addrs.ResourceInstance {
+	return addrs.Resource{
+		Mode: addrs.ManagedResourceMode,
+		Type: "test_thing",
+		Name: name,
+	}.Instance(addrs.NoKey)
+}
+
+// A resource instance that is genuinely destroyed (no current object, no
+// deposed objects) must be removed from state even if it previously had a
+// provider override or a recorded drift status, or else it leaks as a
+// phantom entry forever.
+func TestModule_setResourceInstanceCurrent_finalRemovalClearsAnnotations(t *testing.T) {
+	addr := testInstanceAddr("foo")
+	provider := addrs.AbsProviderConfig{
+		Provider: addrs.NewDefaultProvider("test"),
+		Module:   addrs.RootModule,
+	}
+
+	ms := NewModule(addrs.RootModuleInstance)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+	ms.SetResourceInstanceProvider(addr, provider)
+	ms.MarkResourceInstanceDrift(addr, DriftStatusDrifted, time.Time{})
+
+	if got := ms.ResourceInstance(addr); got == nil {
+		t.Fatalf("instance not present after setup")
+	}
+
+	// Final destroy: no replacement object, nothing deposed.
+	ms.SetResourceInstanceCurrent(addr, nil, provider)
+
+	if got := ms.ResourceInstance(addr); got != nil {
+		t.Fatalf("instance still present after final destroy; annotations leaked it: %#v", got)
+	}
+	if got := ms.Resource(addr.Resource); got != nil {
+		t.Fatalf("parent resource still present after its last instance was destroyed: %#v", got)
+	}
+}
+
+// A provider override and drift record set before a create-before-destroy
+// replacement must still be readable once the full dance completes: depose
+// the old object, set the new current object, then finalize by dropping
+// the stale deposed entry via SetResourceInstanceDeposed(addr, key, nil).
+// The instance never actually becomes empty of objects until that last
+// step, and even then it should end up holding only the new object plus
+// its annotations - not lose the new object to the finalize call, and not
+// leave the stale deposed entry behind.
+func TestModule_createBeforeDestroy_fullRoundTrip(t *testing.T) {
+	addr := testInstanceAddr("foo")
+	provider := addrs.AbsProviderConfig{
+		Provider: addrs.NewDefaultProvider("test"),
+		Module:   addrs.RootModule,
+	}
+
+	ms := NewModule(addrs.RootModuleInstance)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+	ms.SetResourceInstanceProvider(addr, provider)
+	ms.MarkResourceInstanceDrift(addr, DriftStatusDrifted, time.Time{})
+
+	key := ms.DeposeResourceInstanceObject(addr)
+	if key == NotDeposed {
+		t.Fatalf("expected a deposed key")
+	}
+
+	newObj := &ResourceInstanceObject{Status: ObjectReady}
+	ms.SetResourceInstanceCurrent(addr, newObj, provider)
+
+	is := ms.ResourceInstance(addr)
+	if is == nil {
+		t.Fatalf("instance missing mid-dance")
+	}
+	if !is.hasProviderOverride() {
+		t.Errorf("provider override lost mid-dance")
+	}
+	if is.DriftStatus != DriftStatusDrifted {
+		t.Errorf("drift status lost mid-dance, got %v", is.DriftStatus)
+	}
+
+	// Finalize: the replacement succeeded, so drop the stale deposed
+	// object. This must not disturb the new current object.
+	ms.SetResourceInstanceDeposed(addr, key, nil)
+
+	is = ms.ResourceInstance(addr)
+	if is == nil {
+		t.Fatalf("instance disappeared after finalizing the deposed object")
+	}
+	if is.Current != newObj {
+		t.Fatalf("finalizing the stale deposed object clobbered the new current object")
+	}
+	if is.HasDeposed() {
+		t.Fatalf("stale deposed object was not removed by finalization: %#v", is.Deposed)
+	}
+	if !is.hasProviderOverride() {
+		t.Errorf("provider override lost by end of dance")
+	}
+	if is.DriftStatus != DriftStatusDrifted {
+		t.Errorf("drift status lost by end of dance, got %v", is.DriftStatus)
+	}
+}
+
+// LastKnownHash must only be refreshed on an in-sync drift result, so that
+// a later drifted result can still be compared against the last trusted
+// baseline rather than against itself.
+func TestModule_markResourceInstanceDrift_lastKnownHash(t *testing.T) {
+	addr := testInstanceAddr("foo")
+	provider := addrs.AbsProviderConfig{
+		Provider: addrs.NewDefaultProvider("test"),
+		Module:   addrs.RootModule,
+	}
+
+	ms := NewModule(addrs.RootModuleInstance)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+
+	ms.MarkResourceInstanceDrift(addr, DriftStatusInSync, time.Time{})
+	goodHash := ms.ResourceInstance(addr).LastKnownHash
+	if goodHash == "" {
+		t.Fatalf("expected LastKnownHash to be populated after an in-sync check")
+	}
+
+	// Swap in a different current object and report it as drifted:
+	// LastKnownHash must keep pointing at the last known-good object, not
+	// jump to the drifted one.
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectTainted}, provider)
+	ms.MarkResourceInstanceDrift(addr, DriftStatusDrifted, time.Time{})
+
+	if got := ms.ResourceInstance(addr).LastKnownHash; got != goodHash {
+		t.Fatalf("LastKnownHash changed on a drifted result: got %q, want unchanged %q", got, goodHash)
+	}
+
+	// A subsequent in-sync check against the now-current object should
+	// refresh the baseline.
+	ms.MarkResourceInstanceDrift(addr, DriftStatusInSync, time.Time{})
+	if got := ms.ResourceInstance(addr).LastKnownHash; got == goodHash {
+		t.Fatalf("LastKnownHash should have refreshed to match the new in-sync object")
+	}
+}
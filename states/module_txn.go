@@ -0,0 +1,265 @@
+package states
+
+import (
+	"time"
+
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ModuleTxn is a copy-on-write overlay onto a Module that allows a series
+// of mutations to be built up and then either discarded wholesale with
+// Rollback or applied atomically with Commit.
+//
+// A ModuleTxn shares its underlying storage with the Module it was created
+// from until something is actually written through it, so beginning one is
+// cheap even if it ends up unused. Writes copy only the map (Resources,
+// OutputValues, or LocalValues) they touch, and a write to a particular
+// resource copies only that *Resource, so unrelated resources continue to
+// share storage with the base module for the lifetime of the transaction.
+//
+// A ModuleTxn is not safe for concurrent use, and the base Module must not
+// be mutated directly while a transaction derived from it is still live.
+// More generally, routing every write through ModuleTxn in this way is
+// the only thing that makes (*Module).Snapshot safe to call from another
+// goroutine without a lock; see its doc comment for why a mix of direct
+// Module mutation and ModuleTxn is not safe.
+//
+// The zero value of ModuleTxn is not useful; instances are constructed by
+// calling (*Module).Begin.
+type ModuleTxn struct {
+	*Module
+
+	base *Module
+
+	resourcesCopied    bool
+	outputValuesCopied bool
+	localValuesCopied  bool
+	resourceCopied     map[string]bool
+}
+
+// Begin returns a new transaction over the receiving module.
+func (ms *Module) Begin() *ModuleTxn {
+	return &ModuleTxn{
+		Module: &Module{
+			Addr:         ms.Addr,
+			Resources:    ms.Resources,
+			OutputValues: ms.OutputValues,
+			LocalValues:  ms.LocalValues,
+		},
+		base:           ms,
+		resourceCopied: make(map[string]bool),
+	}
+}
+
+// Commit atomically applies all of the changes accumulated in the
+// transaction back to the module it was created from. After Commit the
+// transaction must not be used again.
+func (tx *ModuleTxn) Commit() {
+	tx.base.Resources = tx.Resources
+	tx.base.OutputValues = tx.OutputValues
+	tx.base.LocalValues = tx.LocalValues
+}
+
+// Rollback discards the transaction and all of the changes accumulated in
+// it. Because a ModuleTxn never writes back to the base module until
+// Commit is called, discarding its changes requires nothing more than no
+// longer using it; Rollback exists so callers can make that intent
+// explicit, and it clears the transaction's internal state so that any
+// accidental further use panics loudly rather than silently doing nothing.
+func (tx *ModuleTxn) Rollback() {
+	tx.Module = nil
+	tx.base = nil
+}
+
+// Snapshot returns a read-only point-in-time copy of the receiving module,
+// intended for concurrent use by operations such as plan and show that
+// only need to read the state and must not be disrupted by in-progress
+// mutations made to the original Module afterwards.
+//
+// Unlike a ModuleTxn, a Snapshot does not share its maps with its source:
+// every resource, resource instance, Deposed map and output value
+// reachable from it is copied up front. The *ResourceInstanceObject values
+// themselves are not copied; the snapshot and its source point at the same
+// objects, and the methods of this package only ever replace those
+// pointers, never modify the objects in place. So once Snapshot returns,
+// the result is stable against any later change made to ms through this
+// package's methods.
+//
+// Snapshot itself does no locking: it takes a single uncoordinated pass
+// over ms.Resources/OutputValues/LocalValues. That is only safe to call
+// concurrently with writers if every writer goes exclusively through
+// ModuleTxn (Begin followed by Commit), never through Module's own
+// mutator methods (SetResourceInstanceCurrent, SetOutputValue, and so on)
+// directly on a Module that might be mid-Snapshot on another goroutine -
+// a direct write racing a Snapshot read of the same map is a fatal
+// concurrent map access, not a benign data race. This package does not
+// currently enforce that discipline, and in fact its own callers
+// (including this file's tests) still call Module's mutators directly, so
+// lock-free concurrent Snapshot use is only safe once every writer in a
+// given program has been migrated to ModuleTxn; it is not a property this
+// type provides on its own.
+func (ms *Module) Snapshot() *Module {
+	resources := make(map[string]*Resource, len(ms.Resources))
+	for k, rs := range ms.Resources {
+		resources[k] = cloneResource(rs)
+	}
+	outputValues := make(map[string]*OutputValue, len(ms.OutputValues))
+	for k, os := range ms.OutputValues {
+		osCopy := *os
+		outputValues[k] = &osCopy
+	}
+	localValues := make(map[string]cty.Value, len(ms.LocalValues))
+	for k, v := range ms.LocalValues {
+		localValues[k] = v
+	}
+	return &Module{
+		Addr:         ms.Addr,
+		Resources:    resources,
+		OutputValues: outputValues,
+		LocalValues:  localValues,
+	}
+}
+
+func cloneResource(rs *Resource) *Resource {
+	if rs == nil {
+		return nil
+	}
+	clone := *rs
+	clone.Instances = make(map[addrs.InstanceKey]*ResourceInstance, len(rs.Instances))
+	for k, is := range rs.Instances {
+		clone.Instances[k] = cloneResourceInstance(is)
+	}
+	return &clone
+}
+
+// cloneResourceInstance copies a *ResourceInstance deeply enough that
+// mutating the clone's reference-typed fields (Deposed, ProviderOverride)
+// can never be observed through the original, and vice versa. A plain
+// struct copy isn't enough here: Deposed is a map, so `isCopy := *is`
+// would leave the clone and the original sharing the same underlying map,
+// and a later DeposeCurrentObject on either one would write into storage
+// the other still thinks is private.
+func cloneResourceInstance(is *ResourceInstance) *ResourceInstance {
+	if is == nil {
+		return nil
+	}
+	clone := *is
+	if is.Deposed != nil {
+		clone.Deposed = make(map[DeposedKey]*ResourceInstanceObject, len(is.Deposed))
+		for dk, obj := range is.Deposed {
+			clone.Deposed[dk] = obj
+		}
+	}
+	if is.ProviderOverride != nil {
+		override := *is.ProviderOverride
+		clone.ProviderOverride = &override
+	}
+	return &clone
+}
+
+func (tx *ModuleTxn) ensureResourcesCopied() {
+	if tx.resourcesCopied {
+		return
+	}
+	copied := make(map[string]*Resource, len(tx.Resources))
+	for k, v := range tx.Resources {
+		copied[k] = v
+	}
+	tx.Resources = copied
+	tx.resourcesCopied = true
+}
+
+// ensureResourceCopied makes sure that the *Resource stored under the
+// given key is private to this transaction, copying it from the base
+// module on the first call for that key.
+func (tx *ModuleTxn) ensureResourceCopied(key string) {
+	tx.ensureResourcesCopied()
+	if tx.resourceCopied[key] {
+		return
+	}
+	if rs, ok := tx.Resources[key]; ok {
+		tx.Resources[key] = cloneResource(rs)
+	}
+	tx.resourceCopied[key] = true
+}
+
+func (tx *ModuleTxn) ensureOutputValuesCopied() {
+	if tx.outputValuesCopied {
+		return
+	}
+	copied := make(map[string]*OutputValue, len(tx.OutputValues))
+	for k, v := range tx.OutputValues {
+		copied[k] = v
+	}
+	tx.OutputValues = copied
+	tx.outputValuesCopied = true
+}
+
+func (tx *ModuleTxn) ensureLocalValuesCopied() {
+	if tx.localValuesCopied {
+		return
+	}
+	copied := make(map[string]cty.Value, len(tx.LocalValues))
+	for k, v := range tx.LocalValues {
+		copied[k] = v
+	}
+	tx.LocalValues = copied
+	tx.localValuesCopied = true
+}
+
+// The methods below shadow the corresponding methods promoted from the
+// embedded *Module, inserting the copy-on-write step before delegating to
+// the base implementation so that the transaction's overlay maps are
+// mutated instead of anything reachable from the module it was created
+// from.
+
+func (tx *ModuleTxn) SetResourceMeta(addr addrs.Resource, eachMode EachMode, provider addrs.AbsProviderConfig) {
+	tx.ensureResourceCopied(addr.String())
+	tx.Module.SetResourceMeta(addr, eachMode, provider)
+}
+
+func (tx *ModuleTxn) SetResourceInstanceCurrent(addr addrs.ResourceInstance, obj *ResourceInstanceObject, provider addrs.AbsProviderConfig) {
+	tx.ensureResourceCopied(addr.Resource.String())
+	tx.Module.SetResourceInstanceCurrent(addr, obj, provider)
+}
+
+func (tx *ModuleTxn) SetResourceInstanceDeposed(addr addrs.ResourceInstance, key DeposedKey, obj *ResourceInstanceObject) {
+	tx.ensureResourceCopied(addr.Resource.String())
+	tx.Module.SetResourceInstanceDeposed(addr, key, obj)
+}
+
+func (tx *ModuleTxn) DeposeResourceInstanceObject(addr addrs.ResourceInstance) DeposedKey {
+	tx.ensureResourceCopied(addr.Resource.String())
+	return tx.Module.DeposeResourceInstanceObject(addr)
+}
+
+func (tx *ModuleTxn) SetResourceInstanceProvider(addr addrs.ResourceInstance, provider addrs.AbsProviderConfig) {
+	tx.ensureResourceCopied(addr.Resource.String())
+	tx.Module.SetResourceInstanceProvider(addr, provider)
+}
+
+func (tx *ModuleTxn) MarkResourceInstanceDrift(addr addrs.ResourceInstance, status DriftStatus, checkedAt time.Time) {
+	tx.ensureResourceCopied(addr.Resource.String())
+	tx.Module.MarkResourceInstanceDrift(addr, status, checkedAt)
+}
+
+func (tx *ModuleTxn) SetOutputValue(name string, value cty.Value, sensitive bool) *OutputValue {
+	tx.ensureOutputValuesCopied()
+	return tx.Module.SetOutputValue(name, value, sensitive)
+}
+
+func (tx *ModuleTxn) RemoveOutputValue(name string) {
+	tx.ensureOutputValuesCopied()
+	tx.Module.RemoveOutputValue(name)
+}
+
+func (tx *ModuleTxn) SetLocalValue(name string, value cty.Value) {
+	tx.ensureLocalValuesCopied()
+	tx.Module.SetLocalValue(name, value)
+}
+
+func (tx *ModuleTxn) RemoveLocalValue(name string) {
+	tx.ensureLocalValuesCopied()
+	tx.Module.RemoveLocalValue(name)
+}
@@ -0,0 +1,95 @@
+package states
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/addrs"
+)
+
+// A Snapshot must be fully isolated from its source: mutating the source
+// afterwards, including moving an object into an already-non-empty Deposed
+// map, must never be visible through the snapshot.
+func TestModule_snapshotIsolatedFromSourceDeposed(t *testing.T) {
+	addr := testInstanceAddr("foo")
+	provider := addrs.AbsProviderConfig{
+		Provider: addrs.NewDefaultProvider("test"),
+		Module:   addrs.RootModule,
+	}
+
+	ms := NewModule(addrs.RootModuleInstance)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+	// Give the instance a pre-existing Deposed entry so the clone's map is
+	// non-nil before the source mutates it further.
+	firstKey := ms.DeposeResourceInstanceObject(addr)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+
+	snap := ms.Snapshot()
+	snapInstance := snap.ResourceInstance(addr)
+	if snapInstance == nil {
+		t.Fatalf("snapshot missing instance")
+	}
+	snapDeposedCount := len(snapInstance.Deposed)
+
+	// Mutate the source after the snapshot was taken.
+	ms.DeposeResourceInstanceObject(addr)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+
+	if got := len(ms.ResourceInstance(addr).Deposed); got != snapDeposedCount+1 {
+		t.Fatalf("source should have gained a second deposed object, got %d want %d", got, snapDeposedCount+1)
+	}
+	if got := len(snap.ResourceInstance(addr).Deposed); got != snapDeposedCount {
+		t.Fatalf("snapshot's Deposed map changed after taking the snapshot: got %d want %d (aliased with source)", got, snapDeposedCount)
+	}
+	if _, ok := snapInstance.Deposed[firstKey]; !ok {
+		t.Errorf("snapshot lost its original deposed entry")
+	}
+}
+
+// A depose performed through a ModuleTxn must not be visible on the base
+// module unless the transaction is committed.
+func TestModuleTxn_rollbackDiscardsDepose(t *testing.T) {
+	addr := testInstanceAddr("foo")
+	provider := addrs.AbsProviderConfig{
+		Provider: addrs.NewDefaultProvider("test"),
+		Module:   addrs.RootModule,
+	}
+
+	ms := NewModule(addrs.RootModuleInstance)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+
+	tx := ms.Begin()
+	tx.DeposeResourceInstanceObject(addr)
+	tx.Rollback()
+
+	is := ms.ResourceInstance(addr)
+	if is == nil {
+		t.Fatalf("base instance disappeared after rollback")
+	}
+	if is.HasDeposed() {
+		t.Fatalf("depose performed in a rolled-back transaction leaked into the base module")
+	}
+	if !is.HasCurrent() {
+		t.Fatalf("base module's current object was lost by a rolled-back transaction")
+	}
+}
+
+// Committing a ModuleTxn must apply its changes to the base module.
+func TestModuleTxn_commitAppliesDepose(t *testing.T) {
+	addr := testInstanceAddr("foo")
+	provider := addrs.AbsProviderConfig{
+		Provider: addrs.NewDefaultProvider("test"),
+		Module:   addrs.RootModule,
+	}
+
+	ms := NewModule(addrs.RootModuleInstance)
+	ms.SetResourceInstanceCurrent(addr, &ResourceInstanceObject{Status: ObjectReady}, provider)
+
+	tx := ms.Begin()
+	tx.DeposeResourceInstanceObject(addr)
+	tx.Commit()
+
+	is := ms.ResourceInstance(addr)
+	if is == nil || !is.HasDeposed() {
+		t.Fatalf("committed depose did not apply to the base module")
+	}
+}
@@ -0,0 +1,198 @@
+package states
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/terraform/addrs"
+)
+
+// EachMode specifies the "repetition mode" for a resource, which is
+// tracked alongside the resource's state so that consumers of the state
+// can tell an empty list/map of instances apart from a resource that is
+// not using count or for_each at all.
+type EachMode rune
+
+const (
+	NoEach   EachMode = 0
+	EachList EachMode = 'L'
+	EachMap  EachMode = 'M'
+)
+
+func eachModeForInstanceKey(key addrs.InstanceKey) EachMode {
+	switch key.(type) {
+	case addrs.IntKey:
+		return EachList
+	case addrs.StringKey:
+		return EachMap
+	default:
+		return NoEach
+	}
+}
+
+// Resource represents the state of a resource.
+type Resource struct {
+	// Addr is the absolute address for the resource this state object
+	// belongs to.
+	Addr addrs.Resource
+
+	// Instances contains the instances that are currently tracked for this
+	// resource. The keys in this map are the InstanceKeys of each instance.
+	Instances map[addrs.InstanceKey]*ResourceInstance
+
+	// ProviderConfig is the absolute address of the provider configuration
+	// that most recently managed this resource as a whole. Individual
+	// instances may record their own override via
+	// ResourceInstance.ProviderOverride; see Module.ResourceInstanceProvider.
+	ProviderConfig addrs.AbsProviderConfig
+
+	EachMode EachMode
+}
+
+// Instance returns the state for the instance with the given key, or nil
+// if no such instance is tracked within the state.
+func (rs *Resource) Instance(key addrs.InstanceKey) *ResourceInstance {
+	return rs.Instances[key]
+}
+
+// EnsureInstance returns the state for the instance with the given key,
+// creating a new empty state for it if one doesn't already exist.
+func (rs *Resource) EnsureInstance(key addrs.InstanceKey) *ResourceInstance {
+	ret := rs.Instance(key)
+	if ret == nil {
+		ret = &ResourceInstance{}
+		rs.Instances[key] = ret
+	}
+	return ret
+}
+
+// ResourceInstance represents the state of a particular instance of a
+// resource.
+type ResourceInstance struct {
+	// Current, if non-nil, is the remote object that is currently tracked
+	// for this resource instance.
+	Current *ResourceInstanceObject
+
+	// Deposed, if len > 0, contains any additional remote objects that are
+	// not currently represented but were in the past and have not yet been
+	// cleaned up.
+	Deposed map[DeposedKey]*ResourceInstanceObject
+
+	// ProviderOverride is, if non-nil, an instance-level override of the
+	// resource-wide provider configuration address recorded in
+	// Resource.ProviderConfig. This supports a `provider = ` argument that
+	// appears directly on one count/for_each instance. Use
+	// Module.ResourceInstanceProvider to resolve the effective address.
+	ProviderOverride *addrs.AbsProviderConfig
+
+	// DriftStatus and DriftCheckedAt record the outcome of the most recent
+	// drift detection check for this instance, if any. LastKnownHash is the
+	// Hash of the current object as of the most recent check that reported
+	// DriftStatusInSync; a drifted result leaves it unchanged. See
+	// Module.MarkResourceInstanceDrift.
+	//
+	// No state serializer reads or writes these fields, so a round trip
+	// through a persisted state file loses them; drift is only visible
+	// within the process that recorded it.
+	DriftStatus    DriftStatus
+	DriftCheckedAt time.Time
+	LastKnownHash  string
+}
+
+func (i *ResourceInstance) hasProviderOverride() bool {
+	return i != nil && i.ProviderOverride != nil
+}
+
+func (i *ResourceInstance) HasCurrent() bool {
+	return i != nil && i.Current != nil
+}
+
+func (i *ResourceInstance) HasDeposed() bool {
+	return i != nil && len(i.Deposed) != 0
+}
+
+// HasObjects returns true if this resource instance has any remote objects
+// associated with it, whether current or deposed.
+func (i *ResourceInstance) HasObjects() bool {
+	return i.HasCurrent() || i.HasDeposed()
+}
+
+// DeposeCurrentObject moves the current object, if any, into the Deposed
+// set and returns the newly-allocated deposed key. If there is no current
+// object then this is a no-op and NotDeposed is returned.
+func (i *ResourceInstance) DeposeCurrentObject() DeposedKey {
+	if !i.HasCurrent() {
+		return NotDeposed
+	}
+	key := NotDeposed
+	for {
+		key = DeposedKey(fmt.Sprintf("%08x", rand.Uint32()))
+		if _, exists := i.Deposed[key]; !exists {
+			break
+		}
+	}
+	if i.Deposed == nil {
+		i.Deposed = make(map[DeposedKey]*ResourceInstanceObject)
+	}
+	i.Deposed[key] = i.Current
+	i.Current = nil
+	return key
+}
+
+// DriftStatus is an enumeration of the possible outcomes of a drift
+// detection check performed against a resource instance.
+type DriftStatus rune
+
+const (
+	// DriftStatusUnknown indicates that no drift check has been recorded
+	// for an instance yet.
+	DriftStatusUnknown DriftStatus = 0
+
+	// DriftStatusInSync indicates that the instance matched its
+	// last-known-good state as of the recorded check time.
+	DriftStatusInSync DriftStatus = 'S'
+
+	// DriftStatusDrifted indicates that the instance no longer matches its
+	// last-known-good state as of the recorded check time.
+	DriftStatusDrifted DriftStatus = 'D'
+)
+
+// DeposedKey is the key used within a ResourceInstance's Deposed map to
+// identify a particular deposed object. DeposedKey strings are opaque and
+// must not be interpreted by any caller outside of this package.
+type DeposedKey string
+
+// NotDeposed is a special invalid value of DeposedKey used to represent
+// the absence of a deposed key, e.g. when DeposeCurrentObject is called on
+// an instance with no current object to depose.
+const NotDeposed = DeposedKey("")
+
+// ResourceInstanceObject is a single remote object associated with a
+// resource instance, recorded either as the current generation or as one
+// of the deposed generations.
+type ResourceInstanceObject struct {
+	// Status indicates the lifecycle status of the remote object, such as
+	// whether it is ready for use or tainted.
+	Status ObjectStatus
+}
+
+// Hash returns a hash covering the content of the receiving object,
+// suitable for comparing against a later Hash result to cheaply tell
+// whether an object is known to have changed since the hash was computed.
+func (o *ResourceInstanceObject) Hash() string {
+	if o == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v", o)))
+	return fmt.Sprintf("%x", sum)
+}
+
+// ObjectStatus represents the lifecycle status of a ResourceInstanceObject.
+type ObjectStatus rune
+
+const (
+	ObjectReady   ObjectStatus = 'R'
+	ObjectTainted ObjectStatus = 'T'
+)